@@ -0,0 +1,116 @@
+package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// SASLMechanism selects how a KafkaReceiver authenticates to the cluster.
+type SASLMechanism string
+
+const (
+	SASLMechanismNone        SASLMechanism = ""
+	SASLMechanismPlain       SASLMechanism = "PLAIN"
+	SASLMechanismSCRAMSHA256 SASLMechanism = "SCRAM-SHA-256"
+	SASLMechanismSCRAMSHA512 SASLMechanism = "SCRAM-SHA-512"
+	SASLMechanismOAuthBearer SASLMechanism = "OAUTHBEARER"
+)
+
+// KafkaReceiverConfig configures how a KafkaReceiver reaches a secured
+// cluster (Confluent Cloud, MSK, ...): TLS, SASL authentication and dial
+// timeouts. Apply it with WithReceiverConfig; the same Sarama config is then
+// reused for the DLQ emitter the receiver opens, so it reaches the cluster
+// the same way. A TopicRetryPolicy does not pick it up: it uses the Sarama
+// config passed to NewTopicRetryPolicy.
+type KafkaReceiverConfig struct {
+	TLS           *tls.Config
+	SASLMechanism SASLMechanism
+	SASLUser      string
+	SASLPassword  string
+	// SASLTokenProvider supplies OAUTHBEARER tokens. Required when
+	// SASLMechanism is SASLMechanismOAuthBearer, ignored otherwise.
+	SASLTokenProvider sarama.AccessTokenProvider
+	DialTimeout       time.Duration
+}
+
+func defaultSaramaConfig() *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0 // first version with header support
+	cfg.Producer.Return.Successes = true
+	return cfg
+}
+
+// saramaConfig translates c into a Sarama config built on defaultSaramaConfig.
+func (c KafkaReceiverConfig) saramaConfig() (*sarama.Config, error) {
+	cfg := defaultSaramaConfig()
+
+	if c.DialTimeout > 0 {
+		cfg.Net.DialTimeout = c.DialTimeout
+	}
+	if c.TLS != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = c.TLS
+	}
+
+	switch c.SASLMechanism {
+	case SASLMechanismNone:
+	case SASLMechanismPlain:
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		cfg.Net.SASL.User = c.SASLUser
+		cfg.Net.SASL.Password = c.SASLPassword
+	case SASLMechanismSCRAMSHA256:
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		cfg.Net.SASL.User = c.SASLUser
+		cfg.Net.SASL.Password = c.SASLPassword
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA256}
+		}
+	case SASLMechanismSCRAMSHA512:
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		cfg.Net.SASL.User = c.SASLUser
+		cfg.Net.SASL.Password = c.SASLPassword
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA512}
+		}
+	case SASLMechanismOAuthBearer:
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		cfg.Net.SASL.TokenProvider = c.SASLTokenProvider
+	default:
+		return nil, fmt.Errorf("kafka: unsupported SASL mechanism %q", c.SASLMechanism)
+	}
+
+	return cfg, nil
+}
+
+// scramClient adapts github.com/xdg-go/scram to sarama.SCRAMClient.
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
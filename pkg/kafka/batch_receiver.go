@@ -0,0 +1,248 @@
+package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/icemobilelab/qet/pkg/transform"
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/codec"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchMode selects what happens to a batch once it comes back Nacked.
+type BatchMode int
+
+const (
+	// BatchTransactional retries/DLQs every item in the batch on any failure.
+	BatchTransactional BatchMode = iota
+	// BatchNonTransactional retries/DLQs only the items whose ErrDescription
+	// is set; the rest are treated as acked.
+	BatchNonTransactional
+)
+
+// ConnectBatch buffers incoming messages up to size items, or until the next
+// tick of a fixed flushEvery timer, whichever comes first, and
+// delivers them together as a transform.DataBlockBatch. This amortizes
+// downstream I/O (e.g. one bulk DB insert per batch) across many messages
+// instead of one call per message.
+//
+// Batching trades away the per-message blocking Ack used by Connect: Kafka
+// offsets advance as messages are buffered, ahead of the batch actually being
+// acknowledged downstream. A crash before a buffered batch is flushed loses
+// those messages instead of redelivering them. Shutdown flushes any buffered
+// items, including ones re-queued for another attempt, before returning, so
+// a Shutdown does not lose data. ShutdownContext flushes the same way but
+// drops a batch it cannot deliver, or see acknowledged, before its deadline.
+// Use ConnectBatch for sinks where that tradeoff is acceptable in exchange
+// for the throughput gain.
+func (q *KafkaReceiver) ConnectBatch(
+	ctx context.Context,
+	msgs chan transform.DataBlockBatch,
+	size int,
+	flushEvery time.Duration,
+	mode BatchMode,
+	maxRetries int,
+	retryFuncTime func(int) int,
+	loggerInput *log.Entry) error {
+
+	logger := loggerInput.WithFields(log.Fields{"context": "ConnectBatch"})
+
+	saramaConfig, err := q.saramaConfig()
+	if err != nil {
+		return err
+	}
+
+	if q.retryPolicy == nil {
+		policy, err := NewBackoffRetryPolicy(q.brokers, q.errorTopic, maxRetries, retryFuncTime, saramaConfig, q.extraEmitterOpts, logger)
+		if err != nil {
+			return err
+		}
+		q.retryPolicy = policy
+	}
+
+	b := newBatcher(size, flushEvery, mode, q.topic, q.retryPolicy, &q.inFlight, msgs, logger)
+	q.batcher = b
+
+	graph := goka.DefineGroup(
+		goka.Group(q.group),
+		goka.Input(goka.Stream(q.topic), new(codec.Bytes), b.collect),
+		goka.Persist(new(codec.Bytes)))
+
+	processorOpts := append([]goka.ProcessorOption{
+		goka.WithLogger(logger),
+		goka.WithConsumerGroupBuilder(goka.ConsumerGroupBuilderWithConfig(saramaConfig)),
+		goka.WithProducerBuilder(goka.ProducerBuilderWithConfig(saramaConfig)),
+	}, q.extraProcessorOpts...)
+
+	processor, err := goka.NewProcessor(q.brokers, graph, processorOpts...)
+	if err != nil {
+		return err
+	}
+
+	procCtx, cancel := context.WithCancel(ctx)
+	q.shutdown = cancel
+	go processor.Run(procCtx)
+	go b.run(procCtx)
+	return nil
+}
+
+type batchItem struct {
+	data           []byte
+	errDescription error
+	retryCount     int
+	firstFailureTS time.Time
+}
+
+// batcher accumulates batchItems off the goka callback goroutine and flushes
+// them as a transform.DataBlockBatch whenever size or flushEvery is reached.
+type batcher struct {
+	size       int
+	flushEvery time.Duration
+	mode       BatchMode
+	topic      string
+	policy     RetryPolicy
+	inFlight   *sync.WaitGroup
+	out        chan transform.DataBlockBatch
+	logger     *log.Entry
+
+	mu      sync.Mutex
+	pending []batchItem
+}
+
+func newBatcher(size int, flushEvery time.Duration, mode BatchMode, topic string, policy RetryPolicy, inFlight *sync.WaitGroup, out chan transform.DataBlockBatch, logger *log.Entry) *batcher {
+	return &batcher{
+		size:       size,
+		flushEvery: flushEvery,
+		mode:       mode,
+		topic:      topic,
+		policy:     policy,
+		inFlight:   inFlight,
+		out:        out,
+		logger:     logger.WithFields(log.Fields{"context": "batcher"}),
+	}
+}
+
+// collect is the goka callback: it buffers the message and returns
+// immediately so the processor can move on to the next one, except when the
+// buffer reaches size: it then flushes the batch itself and returns only once
+// the batch has been acked or nacked. It seeds the
+// item's retryCount/firstFailureTS from the x-retry-count/x-first-failure-ts
+// headers (the same ones retryMetaFromHeaders reads for Connect), so a
+// message re-consumed off a TopicRetryPolicy retry topic keeps advancing
+// through stages instead of restarting at stage 0 every flush.
+func (b *batcher) collect(ctx goka.Context, msg interface{}) {
+	data := msg.([]byte)
+	meta := retryMetaFromHeaders(ctx, b.topic)
+
+	b.mu.Lock()
+	b.pending = append(b.pending, batchItem{data: data, retryCount: meta.RetryCount, firstFailureTS: meta.FirstFailureTS})
+	flush := len(b.pending) >= b.size
+	b.mu.Unlock()
+
+	if flush {
+		b.flush()
+	}
+}
+
+// run flushes on a timer, so a slow trickle of messages doesn't wait forever
+// for size to be reached.
+func (b *batcher) run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+func (b *batcher) flush() {
+	b.flushContext(context.Background())
+}
+
+// flushContext behaves like flush but gives up delivering the batch once ctx
+// is done, instead of blocking forever on a downstream that has stopped
+// reading msgs. ShutdownContext uses this so its caller-supplied deadline is
+// actually honored during the final flush; collect/run call flush, which
+// never gives up, since a live pipeline is still reading msgs.
+func (b *batcher) flushContext(ctx context.Context) error {
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	items := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	b.inFlight.Add(1)
+	defer b.inFlight.Done()
+
+	b.logger.Debugf("Flushing batch of %v messages", len(items))
+
+	result := make(chan error, 1)
+	block := transform.DataBlockBatch{
+		Items: toBatchItems(items),
+		Ack:   func() error { result <- nil; return nil },
+		Nack:  func(err error) error { result <- err; return nil },
+	}
+
+	select {
+	case b.out <- block:
+	case <-ctx.Done():
+		b.logger.Warnf("Deadline exceeded delivering a batch of %v messages; they will not be retried", len(items))
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			b.retry(items, block.Items)
+		}
+		return nil
+	case <-ctx.Done():
+		b.logger.Warnf("Deadline exceeded waiting for a batch of %v messages to be acked; it may be lost", len(items))
+		return ctx.Err()
+	}
+}
+
+// retry runs each failed item through the configured RetryPolicy. In
+// transactional mode every item in the batch is retried; in
+// non-transactional mode only the items with ErrDescription set are. Each
+// item carries its own retryCount/firstFailureTS across attempts, so the
+// policy can tell when an item has exhausted its retries instead of seeing a
+// fresh RetryMeta every flush.
+func (b *batcher) retry(items []batchItem, delivered []transform.BatchItem) {
+	for i, original := range items {
+		if b.mode == BatchNonTransactional && delivered[i].ErrDescription == nil {
+			continue
+		}
+
+		it := original
+		if it.firstFailureTS.IsZero() {
+			it.firstFailureTS = time.Now()
+		}
+		meta := RetryMeta{OriginalTopic: b.topic, RetryCount: it.retryCount, FirstFailureTS: it.firstFailureTS, LastError: delivered[i].ErrDescription}
+
+		b.policy.OnNack(it.data, meta, func() {
+			next := it
+			next.retryCount++
+			b.mu.Lock()
+			b.pending = append(b.pending, next)
+			b.mu.Unlock()
+		})
+	}
+}
+
+func toBatchItems(items []batchItem) []transform.BatchItem {
+	out := make([]transform.BatchItem, len(items))
+	for i, it := range items {
+		out[i] = transform.BatchItem{Data: it.data, ErrDescription: it.errDescription}
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+// Package kafkatest wraps github.com/lovoo/goka/tester so pipelines built on
+// kafka.KafkaReceiver can be unit-tested without a real broker.
+package kafkatest // import "github.com/icemobilelab/qet/pkg/kafka/kafkatest"
+
+import (
+	"testing"
+
+	"github.com/icemobilelab/qet/pkg/kafka"
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/tester"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewTestReceiver builds a kafka.KafkaReceiver wired to an in-memory
+// goka.tester instead of a real broker, plus a Harness to drive and inspect
+// it. Call q.Connect (or ConnectCustomRetry/ConnectBatch) as usual, read from
+// the msgs channel in a goroutine, and use the Harness to feed input and
+// assert on the outcome.
+func NewTestReceiver(topic, group string) (*kafka.KafkaReceiver, *Harness) {
+	gt := tester.New(silentT{})
+	errorTopic := topic + ".errors"
+	reg := prometheus.NewRegistry()
+
+	q := kafka.NewKafkaReceiver([]string{"kafkatest"}, group, topic,
+		kafka.WithGokaProcessorOptions(goka.WithTester(gt)),
+		kafka.WithGokaEmitterOptions(goka.WithEmitterTester(gt)),
+		kafka.WithMetricsRegistry(reg),
+	)
+
+	return q, &Harness{
+		tester:     gt,
+		registry:   reg,
+		topic:      topic,
+		errorTopic: errorTopic,
+		dlq:        gt.NewQueueTracker(errorTopic),
+	}
+}
+
+// Harness drives a test KafkaReceiver and asserts on what it did with a
+// message: acked it, retried it, or sent it to the DLQ.
+type Harness struct {
+	tester     *tester.Tester
+	registry   *prometheus.Registry
+	topic      string
+	errorTopic string
+	dlq        *tester.QueueTracker
+
+	retriesBeforeConsume int
+}
+
+// Consume delivers a message to the receiver's input topic, as if it had just
+// been read from Kafka. It snapshots the redelivery count first, so
+// ExpectRetry can report attempts for this message alone.
+func (h *Harness) Consume(key string, value []byte) {
+	if n, err := redeliveryCount(h.registry); err == nil {
+		h.retriesBeforeConsume = n
+	}
+	h.tester.Consume(h.topic, key, value)
+}
+
+// ExpectAck fails t if the message last Consumed ended up on the DLQ topic —
+// i.e. it asserts the message was handled without needing a dead-letter.
+func (h *Harness) ExpectAck(t *testing.T) {
+	t.Helper()
+	if h.dlq.NextSeen() {
+		t.Fatalf("kafkatest: expected message to be acked, but it was sent to %v", h.errorTopic)
+	}
+}
+
+// ExpectDLQ fails t unless a message matching matcher was published to the
+// DLQ topic.
+func (h *Harness) ExpectDLQ(t *testing.T, matcher func(data []byte) bool) {
+	t.Helper()
+	if !h.dlq.NextSeen() {
+		t.Fatalf("kafkatest: expected a message on %v, none was published", h.errorTopic)
+	}
+	var got []byte
+	h.dlq.Next(&got)
+	if !matcher(got) {
+		t.Fatalf("kafkatest: message on %v did not match: %v", h.errorTopic, got)
+	}
+}
+
+// ExpectRetry fails t unless the message last Consumed went through exactly n
+// retry attempts before reaching a terminal state. A terminal attempt (one
+// that reaches the DLQ or hands off to a retry topic rather than being
+// redelivered) is not itself counted as a retry.
+func (h *Harness) ExpectRetry(t *testing.T, n int) {
+	t.Helper()
+
+	got, err := redeliveryCount(h.registry)
+	if err != nil {
+		t.Fatalf("kafkatest: gathering retry metrics: %v", err)
+	}
+	if retries := got - h.retriesBeforeConsume; retries != n {
+		t.Fatalf("kafkatest: expected %d retries, got %d", n, retries)
+	}
+}
+
+// redeliveryCount reads qet_kafka_redeliveries_total's cumulative value, i.e.
+// how many times kafkaMsgProcessor has redelivered a message (the terminal
+// attempt that lands on the DLQ or a retry topic is not itself a
+// redelivery). Callers diff this against a snapshot taken before Consume to
+// isolate a single message's retries.
+func redeliveryCount(reg *prometheus.Registry) (int, error) {
+	mfs, err := reg.Gather()
+	if err != nil {
+		return 0, err
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "qet_kafka_redeliveries_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			return int(m.GetCounter().GetValue()), nil
+		}
+	}
+	return 0, nil
+}
+
+// silentT adapts goka's tester.T interface without requiring a *testing.T:
+// the Harness surfaces failures itself via ExpectAck/ExpectDLQ/ExpectRetry.
+type silentT struct{}
+
+func (silentT) Error(args ...interface{})                 {}
+func (silentT) Errorf(format string, args ...interface{}) {}
+func (silentT) Fatal(args ...interface{})                 {}
+func (silentT) Fatalf(format string, args ...interface{}) {}
@@ -0,0 +1,88 @@
+package kafkatest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/icemobilelab/qet/pkg/kafka/kafkatest"
+	"github.com/icemobilelab/qet/pkg/transform"
+	log "github.com/sirupsen/logrus"
+)
+
+// ackEverything drains msgs and immediately Acks every DataBlock, the
+// steady-state shape most real Connect consumers have.
+func ackEverything(msgs chan transform.DataBlock) {
+	for m := range msgs {
+		m.Ack()
+	}
+}
+
+func TestHarness_ExpectAck(t *testing.T) {
+	q, h := kafkatest.NewTestReceiver("orders", "orders-processor")
+
+	msgs := make(chan transform.DataBlock)
+	done := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := q.Connect(ctx, msgs, done, log.NewEntry(log.New())); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go ackEverything(msgs)
+
+	h.Consume("order-1", []byte("payload"))
+	h.ExpectAck(t)
+}
+
+func TestHarness_ExpectDLQ(t *testing.T) {
+	q, h := kafkatest.NewTestReceiver("orders", "orders-processor")
+
+	msgs := make(chan transform.DataBlock)
+	done := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	noDelay := func(int) int { return 0 }
+	if err := q.ConnectCustomRetry(ctx, msgs, done, 0, noDelay, log.NewEntry(log.New())); err != nil {
+		t.Fatalf("ConnectCustomRetry: %v", err)
+	}
+	go func() {
+		for m := range msgs {
+			m.Nack(errors.New("bad payload"))
+		}
+	}()
+
+	h.Consume("order-2", []byte("bad-payload"))
+	h.ExpectDLQ(t, func(data []byte) bool { return string(data) == "bad-payload" })
+	h.ExpectRetry(t, 0)
+}
+
+func TestHarness_ExpectRetry(t *testing.T) {
+	q, h := kafkatest.NewTestReceiver("orders", "orders-processor")
+
+	msgs := make(chan transform.DataBlock)
+	done := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	noDelay := func(int) int { return 0 }
+	if err := q.ConnectCustomRetry(ctx, msgs, done, 2, noDelay, log.NewEntry(log.New())); err != nil {
+		t.Fatalf("ConnectCustomRetry: %v", err)
+	}
+	attempts := 0
+	go func() {
+		for m := range msgs {
+			attempts++
+			if attempts <= 2 {
+				m.Nack(errors.New("transient"))
+				continue
+			}
+			m.Ack()
+		}
+	}()
+
+	h.Consume("order-3", []byte("payload"))
+	h.ExpectRetry(t, 2)
+	h.ExpectAck(t)
+}
@@ -0,0 +1,69 @@
+package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics holds the Prometheus instruments a KafkaReceiver updates while
+// processing messages. A nil *Metrics (the default, when WithMetricsRegistry
+// is not used) means metrics collection is a no-op.
+type Metrics struct {
+	MessagesReceived  prometheus.Counter
+	Acked             prometheus.Counter
+	Nacked            prometheus.Counter
+	Redeliveries      prometheus.Counter
+	RetryAttempts     prometheus.Histogram
+	DLQEmitted        prometheus.Counter
+	ProcessingLatency prometheus.Histogram
+	MessageBytes      prometheus.Histogram
+}
+
+func newMetrics(reg prometheus.Registerer, constLabels prometheus.Labels) *Metrics {
+	m := &Metrics{
+		MessagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "messages_received_total",
+			Help: "Number of messages received from Kafka.", ConstLabels: constLabels,
+		}),
+		Acked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "acked_total",
+			Help: "Number of messages successfully processed.", ConstLabels: constLabels,
+		}),
+		Nacked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "nacked_total",
+			Help: "Number of Nacks received, including ones that were later retried.", ConstLabels: constLabels,
+		}),
+		Redeliveries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "redeliveries_total",
+			Help: "Number of times a Nacked message was redelivered for another attempt.", ConstLabels: constLabels,
+		}),
+		RetryAttempts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "retry_attempts",
+			Help:    "Number of retry attempts a message had gone through when it was sent to the DLQ or handed to a retry topic; Acked messages are not observed.",
+			Buckets: prometheus.LinearBuckets(0, 1, 10), ConstLabels: constLabels,
+		}),
+		DLQEmitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "dlq_emitted_total",
+			Help: "Number of messages routed to the DLQ topic, including ones whose publish failed.", ConstLabels: constLabels,
+		}),
+		ProcessingLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "processing_latency_seconds",
+			Help:    "End-to-end latency from the Kafka message timestamp to Ack.",
+			Buckets: prometheus.DefBuckets, ConstLabels: constLabels,
+		}),
+		MessageBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "qet", Subsystem: "kafka", Name: "message_bytes",
+			Help:    "Size in bytes of each message processed.",
+			Buckets: prometheus.ExponentialBuckets(64, 2, 10), ConstLabels: constLabels,
+		}),
+	}
+
+	reg.MustRegister(
+		m.MessagesReceived,
+		m.Acked,
+		m.Nacked,
+		m.Redeliveries,
+		m.RetryAttempts,
+		m.DLQEmitted,
+		m.ProcessingLatency,
+		m.MessageBytes,
+	)
+	return m
+}
@@ -0,0 +1,62 @@
+package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
+
+import (
+	"github.com/lovoo/goka"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KafkaReceiverOption configures optional behaviour of a KafkaReceiver —
+// observability hooks, connection security, ... — following the
+// functional-options pattern.
+type KafkaReceiverOption func(*KafkaReceiver)
+
+// WithMetricsRegistry registers this receiver's Prometheus instruments
+// against reg, labelled with its group and topic. Without it, no metrics are
+// collected.
+func WithMetricsRegistry(reg prometheus.Registerer) KafkaReceiverOption {
+	return func(q *KafkaReceiver) {
+		q.metrics = newMetrics(reg, prometheus.Labels{"group": q.group, "topic": q.topic})
+	}
+}
+
+// WithTracerProvider sets the OpenTelemetry TracerProvider used to start a
+// span for every message kafkaMsgProcessor handles. Without it, the global
+// TracerProvider (otel.GetTracerProvider) is used, which is a no-op until the
+// caller registers one.
+func WithTracerProvider(tp trace.TracerProvider) KafkaReceiverOption {
+	return func(q *KafkaReceiver) {
+		q.tracerProvider = tp
+	}
+}
+
+// WithReceiverConfig applies TLS/SASL/dialer settings to the receiver's
+// consumer group and producers, so it can reach secured clusters (Confluent
+// Cloud, MSK, ...). The same settings are reused for the DLQ emitter the
+// receiver constructs; they are not applied to a TopicRetryPolicy, which
+// takes its own Sarama config.
+func WithReceiverConfig(cfg KafkaReceiverConfig) KafkaReceiverOption {
+	return func(q *KafkaReceiver) {
+		q.receiverConfig = &cfg
+	}
+}
+
+// WithGokaProcessorOptions appends extra goka.ProcessorOptions to the ones
+// startConsumer builds from WithReceiverConfig, applied last so they can
+// override the default consumer-group/producer builders. Intended for
+// kafkatest, which injects goka.WithTester here; most callers won't need it.
+func WithGokaProcessorOptions(opts ...goka.ProcessorOption) KafkaReceiverOption {
+	return func(q *KafkaReceiver) {
+		q.extraProcessorOpts = append(q.extraProcessorOpts, opts...)
+	}
+}
+
+// WithGokaEmitterOptions appends extra goka.EmitterOptions to the DLQ emitter
+// BackoffRetryPolicy opens, applied last so they can override its default
+// producer builder. Intended for kafkatest, which injects
+// goka.WithEmitterTester here; most callers won't need it.
+func WithGokaEmitterOptions(opts ...goka.EmitterOption) KafkaReceiverOption {
+	return func(q *KafkaReceiver) {
+		q.extraEmitterOpts = append(q.extraEmitterOpts, opts...)
+	}
+}
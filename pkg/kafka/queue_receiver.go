@@ -2,38 +2,76 @@ package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
 
 import (
 	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
 	"github.com/icemobilelab/qet/pkg/transform"
 	"github.com/lovoo/goka"
 	"github.com/lovoo/goka/codec"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"math"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type KafkaReceiver struct {
-	brokers    []string
-	group      string
-	topic      string
-	errorTopic string
-	shutdown   func()
+	brokers        []string
+	group          string
+	topic          string
+	errorTopic     string
+	retryPolicy    RetryPolicy
+	metrics        *Metrics
+	tracerProvider trace.TracerProvider
+	receiverConfig *KafkaReceiverConfig
+	inFlight       sync.WaitGroup
+	batcher        *batcher
+
+	extraProcessorOpts []goka.ProcessorOption
+	extraEmitterOpts   []goka.EmitterOption
+
+	shutdown func()
 }
 
-func NewKafkaReceiver(brokers []string, group, topic string) *KafkaReceiver {
+func NewKafkaReceiver(brokers []string, group, topic string, opts ...KafkaReceiverOption) *KafkaReceiver {
 	q := KafkaReceiver{
-		brokers:    brokers,
-		group:      group,
-		topic:      topic,
-		errorTopic: topic + ".errors",
+		brokers:        brokers,
+		group:          group,
+		topic:          topic,
+		errorTopic:     topic + ".errors",
+		tracerProvider: otel.GetTracerProvider(),
+	}
+	for _, opt := range opts {
+		opt(&q)
 	}
 	return &q
 }
 
+// NewKafkaReceiverWithRetryPolicy builds a receiver that delegates retry
+// handling to policy instead of the default in-memory backoff, e.g. a
+// TopicRetryPolicy built with NewTopicRetryPolicy.
+func NewKafkaReceiverWithRetryPolicy(brokers []string, group, topic string, policy RetryPolicy, opts ...KafkaReceiverOption) *KafkaReceiver {
+	q := NewKafkaReceiver(brokers, group, topic, opts...)
+	q.retryPolicy = policy
+	return q
+}
+
+// Connect starts the receiver. ctx is the parent of every transform.DataBlock
+// delivered to msgs (so downstream code can pick up cancellation, deadlines
+// and request-scoped values) and of the processor's own run loop: cancelling
+// ctx stops the processor, but unlike Shutdown it does not wait for in-flight
+// messages or close the DLQ/retry-topic emitter.
 func (q *KafkaReceiver) Connect(
+	ctx context.Context,
 	msgs chan transform.DataBlock,
 	done chan error,
 	logger *log.Entry) error {
 
 	return q.ConnectCustomRetry(
+		ctx,
 		msgs,
 		done,
 		3,
@@ -44,6 +82,7 @@ func (q *KafkaReceiver) Connect(
 }
 
 func (q *KafkaReceiver) ConnectCustomRetry(
+	ctx context.Context,
 	msgs chan transform.DataBlock,
 	done chan error,
 	maxRetries int,
@@ -52,7 +91,20 @@ func (q *KafkaReceiver) ConnectCustomRetry(
 
 	logger := loggerInput.WithFields(log.Fields{"context": "ConnectCustomRetry"})
 
-	err := q.startConsumer(msgs, maxRetries, retryFuncTime, logger)
+	saramaConfig, err := q.saramaConfig()
+	if err != nil {
+		return err
+	}
+
+	if q.retryPolicy == nil {
+		policy, err := NewBackoffRetryPolicy(q.brokers, q.errorTopic, maxRetries, retryFuncTime, saramaConfig, q.extraEmitterOpts, logger)
+		if err != nil {
+			return err
+		}
+		q.retryPolicy = policy
+	}
+
+	err = q.startConsumer(ctx, msgs, saramaConfig, logger)
 	if err != nil {
 		logger.Error("error and shutting down: %v", err)
 		defer q.Shutdown(logger)
@@ -63,10 +115,20 @@ func (q *KafkaReceiver) ConnectCustomRetry(
 
 }
 
+// saramaConfig returns the Sarama config to use for the consumer group and
+// any emitters this receiver opens, translating receiverConfig (TLS, SASL,
+// dial timeout) when one was supplied via WithReceiverConfig.
+func (q *KafkaReceiver) saramaConfig() (*sarama.Config, error) {
+	if q.receiverConfig == nil {
+		return defaultSaramaConfig(), nil
+	}
+	return q.receiverConfig.saramaConfig()
+}
+
 func (q *KafkaReceiver) startConsumer(
+	ctx context.Context,
 	msgs chan transform.DataBlock,
-	maxRetries int,
-	retryExpirationCalc func(int) int,
+	saramaConfig *sarama.Config,
 	loggerInput *log.Entry) error {
 
 	logger := loggerInput.WithFields(log.Fields{
@@ -78,10 +140,15 @@ func (q *KafkaReceiver) startConsumer(
 	graph := goka.DefineGroup(
 		goka.Group(q.group),
 		goka.Input(goka.Stream(q.topic), new(codec.Bytes),
-			kafkaMsgProcessor(msgs, q.brokers, q.errorTopic, maxRetries, retryExpirationCalc, logger)),
+			kafkaMsgProcessor(msgs, q.topic, q.retryPolicy, q.metrics, q.tracerProvider, &q.inFlight, ctx, logger)),
 		goka.Persist(new(codec.Bytes)))
-	opts := []goka.ProcessorOption{}
-	opts = append(opts, goka.WithLogger(logger))
+
+	opts := []goka.ProcessorOption{
+		goka.WithLogger(logger),
+		goka.WithConsumerGroupBuilder(goka.ConsumerGroupBuilderWithConfig(saramaConfig)),
+		goka.WithProducerBuilder(goka.ProducerBuilderWithConfig(saramaConfig)),
+	}
+	opts = append(opts, q.extraProcessorOpts...)
 
 	logger.Println("Starting goka processor")
 	processor, err := goka.NewProcessor(q.brokers, graph, opts...)
@@ -89,87 +156,184 @@ func (q *KafkaReceiver) startConsumer(
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	procCtx, cancel := context.WithCancel(ctx)
 	q.shutdown = cancel
-	go processor.Run(ctx) // cancel context will stop the process
+	go processor.Run(procCtx) // cancel context will stop the process
 	return nil
 }
 
+// Shutdown stops the receiver and waits indefinitely for every in-flight
+// DataBlock to Ack/Nack before flushing the DLQ/retry-topic emitter. Prefer
+// ShutdownContext to bound that wait with a deadline.
 func (q *KafkaReceiver) Shutdown(loggerInput *log.Entry) error {
-	logger := loggerInput.WithFields(log.Fields{"context": "Shutdown"})
+	return q.ShutdownContext(context.Background(), loggerInput)
+}
+
+// ShutdownContext stops accepting new messages, waits (up to ctx) for every
+// in-flight DataBlock to finish its Ack/Nack, then flushes the DLQ/retry-topic
+// emitter. It returns an error if ctx is done before the drain completes.
+func (q *KafkaReceiver) ShutdownContext(ctx context.Context, loggerInput *log.Entry) error {
+	logger := loggerInput.WithFields(log.Fields{"context": "ShutdownContext"})
+
+	logger.Println("Shutting down goka processor")
+	if q.shutdown != nil {
+		q.shutdown()
+	}
+
+	if q.batcher != nil {
+		logger.Println("Flushing buffered batch before shutdown")
+		// Items Nacked in a flush may be re-queued for another attempt, so
+		// keep flushing until the buffer stays empty.
+		for {
+			q.batcher.mu.Lock()
+			pending := len(q.batcher.pending)
+			q.batcher.mu.Unlock()
+			if pending == 0 {
+				break
+			}
+			if err := q.batcher.flushContext(ctx); err != nil {
+				logger.Warnf("Final batch flush did not complete before shutdown deadline: %v", err)
+				break
+			}
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		q.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		logger.Println("All in-flight messages drained")
+	case <-ctx.Done():
+		return fmt.Errorf("kafka: shutdown drain deadline exceeded: %w", ctx.Err())
+	}
 
-	logger.Println("Shutting down goka processors")
-	q.shutdown()
+	switch policy := q.retryPolicy.(type) {
+	case *TopicRetryPolicy:
+		return policy.Finish()
+	case *BackoffRetryPolicy:
+		return policy.Finish()
+	}
 	return nil
 }
 
+// retryMetaFromHeaders seeds a RetryMeta for a freshly-consumed message from
+// the x-retry-count/x-first-failure-ts headers TopicRetryPolicy.OnNack writes
+// before forwarding to a retry topic. Without this, a message re-delivered by
+// KafkaRetryReceiver would always look like a first attempt, so it would
+// never advance past the first retry stage or reach the DLQ. A message with
+// no such headers (a genuinely new message) gets the zero RetryMeta.
+func retryMetaFromHeaders(ctx goka.Context, topic string) RetryMeta {
+	meta := RetryMeta{OriginalTopic: topic}
+
+	headers := ctx.Headers()
+	if raw, ok := headers[HeaderRetryCount]; ok {
+		if n, err := strconv.Atoi(string(raw)); err == nil {
+			meta.RetryCount = n
+		}
+	}
+	if raw, ok := headers[HeaderFirstFailure]; ok {
+		if ts, err := time.Parse(time.RFC3339Nano, string(raw)); err == nil {
+			meta.FirstFailureTS = ts
+		}
+	}
+	if raw, ok := headers[HeaderOriginalTopic]; ok && len(raw) > 0 {
+		meta.OriginalTopic = string(raw)
+	}
+
+	return meta
+}
+
 // Message processor: encapsulate the goka processor with domain injections
 func kafkaMsgProcessor(
 	output chan transform.DataBlock,
-	brokers []string,
-	errorTopic string,
-	maxRetries int,
-	retryExpirationCalc func(int) int,
+	topic string,
+	retryPolicy RetryPolicy,
+	metrics *Metrics,
+	tracerProvider trace.TracerProvider,
+	inFlight *sync.WaitGroup,
+	baseCtx context.Context,
 	loggerInput *log.Entry) func(ctx goka.Context, msg interface{}) {
 
 	logger := loggerInput.WithFields(log.Fields{"context": "kafkaMsgProcessor"})
+	tracer := tracerProvider.Tracer("github.com/icemobilelab/qet/pkg/kafka")
 
 	return func(ctx goka.Context, msg interface{}) {
 		logger.Println("Message received")
 
+		inFlight.Add(1)
+		defer inFlight.Done()
+
 		data := msg.([]byte)
+		if metrics != nil {
+			metrics.MessagesReceived.Inc()
+			metrics.MessageBytes.Observe(float64(len(data)))
+		}
+
+		msgCtx, span := tracer.Start(baseCtx, "kafka.process")
+		span.SetAttributes(attribute.String("messaging.destination", topic))
+		defer span.End()
 
-		result := make(chan bool, maxRetries+1)
+		result := make(chan error, 4)
 
 		db := transform.DataBlock{
-			Data: data,
-			Ack:  func() error { result <- true; return nil },
-			Nack: func() error { result <- false; return nil },
+			Data:    data,
+			Context: msgCtx,
+			Ack:     func() error { result <- nil; return nil },
+			Nack:    func(err error) error { result <- err; return nil },
 		}
 
 		output <- db
 
-		retries := 0
+		meta := retryMetaFromHeaders(ctx, topic)
+
 		// blocking waiting for response
 		for {
 			select {
-			case res := <-result:
-				if res {
+			case err := <-result:
+				if err == nil {
 					// it's ok, just finish and go for next message
 					logger.Printf("Success on message process")
+					if metrics != nil {
+						metrics.Acked.Inc()
+						metrics.ProcessingLatency.Observe(time.Since(ctx.Timestamp()).Seconds())
+					}
+					span.SetStatus(codes.Ok, "")
 					return
 				}
-				// !res
-				// error, retry mechanism
-				if retries >= maxRetries {
 
-					// not possible to recover from error: move message to dead-letter and log it
-					logger.Warnf("Too much retries, not possible to process the message (copy at %v)", errorTopic)
+				// error, retry mechanism
+				if metrics != nil {
+					metrics.Nacked.Inc()
+				}
+				if meta.FirstFailureTS.IsZero() {
+					meta.FirstFailureTS = time.Now()
+				}
+				meta.LastError = err
+				span.AddEvent("retry", trace.WithAttributes(
+					attribute.Int("retry.count", meta.RetryCount),
+					attribute.String("retry.error", err.Error())))
 
-					pub, err := goka.NewEmitter(brokers, goka.Stream(errorTopic), new(codec.Bytes))
-					if err != nil {
-						logger.Errorf("Error creating publisher to track error message: %v", err)
-						return
+				decision := retryPolicy.OnNack(data, meta, func() { output <- db })
+				if decision == RetryDecisionRedelivered {
+					if metrics != nil {
+						metrics.Redeliveries.Inc()
 					}
-					defer pub.Finish()
-					err = pub.EmitSync("", data)
-					if err != nil {
-						logger.Errorf("Error publishing error message (potentially lost): %v", err)
-						return
+					meta.RetryCount++
+					continue
+				}
+
+				if metrics != nil {
+					metrics.RetryAttempts.Observe(float64(meta.RetryCount))
+					if decision == RetryDecisionDLQ {
+						metrics.DLQEmitted.Inc()
 					}
-					logger.Infof("Error message reported correctly to %v", errorTopic)
-					return
 				}
-				// timeout define by the function
-				delay := time.Duration(retryExpirationCalc(retries)) * time.Millisecond
-				logger.Debugf("Waiting on retry %v for %v", retries, delay)
-				timer := time.NewTimer(delay)
-				<-timer.C
-
-				// retry to process the message again
-				logger.Printf("Retry %v", retries)
-				output <- db
-				retries++
+				span.SetStatus(codes.Error, err.Error())
+				return
 			}
 		}
 	}
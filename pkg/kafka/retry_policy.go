@@ -0,0 +1,212 @@
+package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/codec"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers attached to messages forwarded along a retry-topic chain. They let
+// every stage (and the final consumer, once re-delivered) reconstruct how a
+// message got there without looking anything up.
+const (
+	HeaderRetryCount    = "x-retry-count"
+	HeaderOriginalTopic = "x-original-topic"
+	HeaderFirstFailure  = "x-first-failure-ts"
+	HeaderLastError     = "x-last-error"
+)
+
+// RetryMeta is the bookkeeping kafkaMsgProcessor carries across retries of a
+// single message so a RetryPolicy can decide, and later record, what to do.
+type RetryMeta struct {
+	OriginalTopic  string
+	RetryCount     int
+	FirstFailureTS time.Time
+	LastError      error
+}
+
+// RetryDecision is returned by RetryPolicy.OnNack to tell kafkaMsgProcessor
+// whether it should keep waiting on the result channel or stop.
+type RetryDecision int
+
+const (
+	// RetryDecisionRedelivered means the policy pushed the message back onto
+	// the in-process output channel itself (the legacy backoff behaviour);
+	// the processor should keep waiting for another Ack/Nack.
+	RetryDecisionRedelivered RetryDecision = iota
+	// RetryDecisionTerminal means the policy handed the message off to
+	// another retry stage (not the DLQ); the processor can Ack Kafka and
+	// move on to the next message, but the message itself is still alive.
+	RetryDecisionTerminal
+	// RetryDecisionDLQ means the policy routed the message to its
+	// dead-letter destination (a failed publish is logged and still reported
+	// as RetryDecisionDLQ); like RetryDecisionTerminal the processor can
+	// move on, but the message's retry chain has actually ended here.
+	RetryDecisionDLQ
+)
+
+// RetryPolicy decides what happens to a message each time it is Nacked.
+// BackoffRetryPolicy keeps the original in-memory, partition-blocking
+// behaviour; TopicRetryPolicy defers retries to a chain of delay topics so
+// other messages on the partition keep flowing.
+type RetryPolicy interface {
+	OnNack(data []byte, meta RetryMeta, redeliver func()) RetryDecision
+}
+
+// BackoffRetryPolicy sleeps for retryExpirationCalc(retry) between attempts,
+// blocking the partition, and moves the message to errorTopic once maxRetries
+// is exhausted. This is the original behaviour of kafkaMsgProcessor.
+type BackoffRetryPolicy struct {
+	brokers             []string
+	errorTopic          string
+	maxRetries          int
+	retryExpirationCalc func(int) int
+	saramaConfig        *sarama.Config
+	emitter             *goka.Emitter
+	logger              *log.Entry
+}
+
+// NewBackoffRetryPolicy builds the in-process, partition-blocking retry
+// policy used by Connect and ConnectCustomRetry. It opens the DLQ emitter
+// once, up front, and reuses it for every message that exhausts maxRetries,
+// instead of dialing a fresh producer per failure. saramaConfig is used to
+// reach the cluster the same way (TLS/SASL) the receiver does; pass nil to
+// use sane defaults. extraEmitterOpts are appended last, so callers (e.g.
+// kafkatest) can override the producer builder. Call Finish when the
+// receiver shuts down.
+func NewBackoffRetryPolicy(brokers []string, errorTopic string, maxRetries int, retryExpirationCalc func(int) int, saramaConfig *sarama.Config, extraEmitterOpts []goka.EmitterOption, logger *log.Entry) (*BackoffRetryPolicy, error) {
+	if saramaConfig == nil {
+		saramaConfig = defaultSaramaConfig()
+	}
+
+	emitterOpts := append([]goka.EmitterOption{
+		goka.WithEmitterProducerBuilder(goka.ProducerBuilderWithConfig(saramaConfig)),
+	}, extraEmitterOpts...)
+
+	emitter, err := goka.NewEmitter(brokers, goka.Stream(errorTopic), new(codec.Bytes), emitterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating DLQ emitter: %w", err)
+	}
+
+	return &BackoffRetryPolicy{
+		brokers:             brokers,
+		errorTopic:          errorTopic,
+		maxRetries:          maxRetries,
+		retryExpirationCalc: retryExpirationCalc,
+		saramaConfig:        saramaConfig,
+		emitter:             emitter,
+		logger:              logger.WithFields(log.Fields{"context": "BackoffRetryPolicy"}),
+	}, nil
+}
+
+func (p *BackoffRetryPolicy) OnNack(data []byte, meta RetryMeta, redeliver func()) RetryDecision {
+	if meta.RetryCount >= p.maxRetries {
+		p.logger.Warnf("Too much retries, not possible to process the message (copy at %v)", p.errorTopic)
+
+		if err := p.emitter.EmitSync("", data); err != nil {
+			p.logger.Errorf("Error publishing error message (potentially lost): %v", err)
+			return RetryDecisionDLQ
+		}
+		p.logger.Infof("Error message reported correctly to %v", p.errorTopic)
+		return RetryDecisionDLQ
+	}
+
+	delay := time.Duration(p.retryExpirationCalc(meta.RetryCount)) * time.Millisecond
+	p.logger.Debugf("Waiting on retry %v for %v", meta.RetryCount, delay)
+	timer := time.NewTimer(delay)
+	<-timer.C
+
+	p.logger.Printf("Retry %v", meta.RetryCount)
+	redeliver()
+	return RetryDecisionRedelivered
+}
+
+// Finish releases the DLQ emitter. Call it from Shutdown/ShutdownContext.
+func (p *BackoffRetryPolicy) Finish() error {
+	return p.emitter.Finish()
+}
+
+// RetryStage is one hop of a retry-topic chain: a topic name and how long a
+// message should sit there before being forwarded for re-processing.
+type RetryStage struct {
+	Topic string
+	Delay time.Duration
+}
+
+// TopicRetryPolicy implements the "cronsumer"/retry-topic pattern: on Nack it
+// immediately emits the message to the next stage in the chain (or to
+// dlqTopic once the chain is exhausted) instead of sleeping in-process, so
+// the partition is never blocked.
+type TopicRetryPolicy struct {
+	stages   []RetryStage
+	dlqTopic string
+	producer sarama.SyncProducer
+	logger   *log.Entry
+}
+
+// NewTopicRetryPolicy opens a Sarama producer capable of writing headers and
+// returns a RetryPolicy that walks stages in order, falling back to dlqTopic
+// once they are exhausted. saramaConfig may be nil to use sane defaults, or
+// set (e.g. via KafkaReceiverConfig.saramaConfig) to reach a secured cluster.
+func NewTopicRetryPolicy(brokers []string, stages []RetryStage, dlqTopic string, saramaConfig *sarama.Config, logger *log.Entry) (*TopicRetryPolicy, error) {
+	if saramaConfig == nil {
+		saramaConfig = defaultSaramaConfig()
+	}
+
+	producer, err := sarama.NewSyncProducer(brokers, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating retry-topic producer: %w", err)
+	}
+
+	return &TopicRetryPolicy{
+		stages:   stages,
+		dlqTopic: dlqTopic,
+		producer: producer,
+		logger:   logger.WithFields(log.Fields{"context": "TopicRetryPolicy"}),
+	}, nil
+}
+
+func (p *TopicRetryPolicy) OnNack(data []byte, meta RetryMeta, redeliver func()) RetryDecision {
+	target := p.dlqTopic
+	decision := RetryDecisionDLQ
+	if meta.RetryCount < len(p.stages) {
+		target = p.stages[meta.RetryCount].Topic
+		decision = RetryDecisionTerminal
+	}
+
+	lastErr := ""
+	if meta.LastError != nil {
+		lastErr = meta.LastError.Error()
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: target,
+		Value: sarama.ByteEncoder(data),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(HeaderRetryCount), Value: []byte(fmt.Sprintf("%d", meta.RetryCount+1))},
+			{Key: []byte(HeaderOriginalTopic), Value: []byte(meta.OriginalTopic)},
+			{Key: []byte(HeaderFirstFailure), Value: []byte(meta.FirstFailureTS.UTC().Format(time.RFC3339Nano))},
+			{Key: []byte(HeaderLastError), Value: []byte(lastErr)},
+		},
+	}
+
+	if _, _, err := p.producer.SendMessage(msg); err != nil {
+		p.logger.Errorf("Error emitting message to %v (potentially lost): %v", target, err)
+	} else {
+		p.logger.Infof("Message forwarded to %v (retry %v)", target, meta.RetryCount+1)
+	}
+
+	// Always terminal from the processor's point of view: Kafka is Acked
+	// either way so the partition advances, and the message itself is now
+	// tracked by the retry/DLQ topic. decision distinguishes which.
+	return decision
+}
+
+// Finish releases the underlying producer. Call it from Shutdown.
+func (p *TopicRetryPolicy) Finish() error {
+	return p.producer.Close()
+}
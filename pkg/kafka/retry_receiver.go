@@ -0,0 +1,140 @@
+package kafka // import "github.com/icemobilelab/qet/pkg/kafka"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/codec"
+	log "github.com/sirupsen/logrus"
+)
+
+// KafkaRetryReceiver consumes a single retry topic, waits out its delay
+// relative to the Kafka timestamp of each message, and forwards it back to
+// the original topic for re-processing. It is the companion half of
+// TopicRetryPolicy: KafkaReceiver emits into a retry topic, KafkaRetryReceiver
+// drains it once the delay has elapsed.
+type KafkaRetryReceiver struct {
+	brokers      []string
+	group        string
+	stage        RetryStage
+	producer     sarama.SyncProducer
+	saramaConfig *sarama.Config
+	inFlight     sync.WaitGroup
+	shutdown     func()
+}
+
+// NewKafkaRetryReceiver builds a receiver for a single RetryStage.
+// saramaConfig may be nil to use sane defaults, or set (e.g. via
+// KafkaReceiverConfig.saramaConfig) to reach a secured cluster.
+func NewKafkaRetryReceiver(brokers []string, group string, stage RetryStage, saramaConfig *sarama.Config) (*KafkaRetryReceiver, error) {
+	if saramaConfig == nil {
+		saramaConfig = defaultSaramaConfig()
+	}
+
+	producer, err := sarama.NewSyncProducer(brokers, saramaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaRetryReceiver{
+		brokers:      brokers,
+		group:        group,
+		stage:        stage,
+		producer:     producer,
+		saramaConfig: saramaConfig,
+	}, nil
+}
+
+// Connect starts consuming r.stage.Topic. Each message's delay is waited out
+// in a background goroutine rather than the goka callback, so one message
+// sitting out a long stage (e.g. topic.retry.1h) doesn't block the rest of
+// the partition behind it; Shutdown waits for those goroutines to finish
+// before closing the producer. Once r.stage.Delay has elapsed since a
+// message's Kafka timestamp, it is re-emitted to the topic recorded in its
+// HeaderOriginalTopic header so the main KafkaReceiver picks it up again.
+//
+// Because the callback returns (and goka commits the offset) before the
+// delayed goroutine re-emits, a crash during the wait — up to the full
+// r.stage.Delay — silently drops the message instead of redelivering it;
+// this trades strict at-least-once delivery for not blocking the partition.
+func (r *KafkaRetryReceiver) Connect(loggerInput *log.Entry) error {
+	logger := loggerInput.WithFields(log.Fields{
+		"context": "KafkaRetryReceiver.Connect",
+		"group":   r.group,
+		"topic":   r.stage.Topic})
+
+	graph := goka.DefineGroup(
+		goka.Group(r.group),
+		goka.Input(goka.Stream(r.stage.Topic), new(codec.Bytes), r.forward(logger)),
+		goka.Persist(new(codec.Bytes)))
+
+	processor, err := goka.NewProcessor(r.brokers, graph,
+		goka.WithLogger(logger),
+		goka.WithConsumerGroupBuilder(goka.ConsumerGroupBuilderWithConfig(r.saramaConfig)),
+		goka.WithProducerBuilder(goka.ProducerBuilderWithConfig(r.saramaConfig)))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.shutdown = cancel
+	go processor.Run(ctx)
+	return nil
+}
+
+func (r *KafkaRetryReceiver) forward(logger *log.Entry) func(ctx goka.Context, msg interface{}) {
+	return func(ctx goka.Context, msg interface{}) {
+		data := msg.([]byte)
+		headers := ctx.Headers()
+		remaining := r.stage.Delay - time.Since(ctx.Timestamp())
+
+		originalTopic := string(headers[HeaderOriginalTopic])
+		if originalTopic == "" {
+			originalTopic = r.stage.Topic
+		}
+		recordHeaders := headersToRecordHeaders(headers)
+
+		r.inFlight.Add(1)
+		go func() {
+			defer r.inFlight.Done()
+
+			if remaining > 0 {
+				timer := time.NewTimer(remaining)
+				<-timer.C
+			}
+
+			out := &sarama.ProducerMessage{
+				Topic:   originalTopic,
+				Value:   sarama.ByteEncoder(data),
+				Headers: recordHeaders,
+			}
+			if _, _, err := r.producer.SendMessage(out); err != nil {
+				logger.Errorf("Error re-emitting delayed message to %v: %v", originalTopic, err)
+				return
+			}
+			logger.Debugf("Forwarded delayed message back to %v", originalTopic)
+		}()
+	}
+}
+
+// Shutdown stops the retry consumer, waits for every in-flight delayed
+// forward to finish, then closes the producer.
+func (r *KafkaRetryReceiver) Shutdown(loggerInput *log.Entry) error {
+	loggerInput.WithFields(log.Fields{"context": "KafkaRetryReceiver.Shutdown"}).Println("Shutting down retry processor")
+	if r.shutdown != nil {
+		r.shutdown()
+	}
+	r.inFlight.Wait()
+	return r.producer.Close()
+}
+
+func headersToRecordHeaders(headers map[string][]byte) []sarama.RecordHeader {
+	out := make([]sarama.RecordHeader, 0, len(headers))
+	for k, v := range headers {
+		out = append(out, sarama.RecordHeader{Key: []byte(k), Value: v})
+	}
+	return out
+}
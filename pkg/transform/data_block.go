@@ -0,0 +1,37 @@
+package transform // import "github.com/icemobilelab/qet/pkg/transform"
+
+import "context"
+
+// DataBlock is the unit of work handed from a receiver (e.g. KafkaReceiver)
+// to downstream processing code. Callers must invoke exactly one of Ack or
+// Nack once the payload has been handled, so the receiver knows whether to
+// advance, retry or dead-letter it.
+type DataBlock struct {
+	Data []byte
+	// Context carries request-scoped values set up by the receiver, e.g. the
+	// active trace span, a logger, or a deadline. Downstream code should
+	// derive from it (context.WithValue, context.WithTimeout) rather than
+	// build a new background context.
+	Context context.Context
+	Ack     func() error
+	Nack    func(err error) error
+}
+
+// DataBlockBatch groups several payloads delivered together so a sink can
+// amortize its I/O (e.g. a single bulk insert) across all of them. Ack/Nack
+// apply to the whole batch. In non-transactional retry mode only the Items
+// with ErrDescription set are retried/dead-lettered; the rest are treated as
+// acked.
+type DataBlockBatch struct {
+	Items []BatchItem
+	Ack   func() error
+	Nack  func(err error) error
+}
+
+// BatchItem is one payload within a DataBlockBatch. Consumers set
+// ErrDescription on the items that failed before calling DataBlockBatch.Nack,
+// so a non-transactional retry can single them out from the rest of the batch.
+type BatchItem struct {
+	Data           []byte
+	ErrDescription error
+}